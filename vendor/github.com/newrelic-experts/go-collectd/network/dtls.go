@@ -0,0 +1,280 @@
+package network
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pion/dtls/v2"
+)
+
+// PeerIdentity identifies the remote party of a DTLS association, so
+// api.Writer implementations can attribute the ValueLists they receive
+// to a peer.
+type PeerIdentity struct {
+	// Addr is the peer's network address. Nil for packets that did not
+	// arrive over DTLS.
+	Addr net.Addr
+	// CommonName is the subject common name from the peer's leaf
+	// certificate, when certificate-based authentication was used.
+	CommonName string
+	// PSKIdentityHint is the identity hint negotiated in PSK mode.
+	PSKIdentityHint []byte
+}
+
+type peerIdentityKey struct{}
+
+// PeerIdentityFromContext returns the PeerIdentity a DTLS association
+// attached to ctx, if any.
+func PeerIdentityFromContext(ctx context.Context) (PeerIdentity, bool) {
+	id, ok := ctx.Value(peerIdentityKey{}).(PeerIdentity)
+	return id, ok
+}
+
+// listenAndWriteDTLS is the DTLSConfig counterpart of ListenAndWrite: it
+// accepts DTLS associations rather than reading arbitrary-peer UDP
+// datagrams, but otherwise uses the same kind of buffer pool, packet queue
+// and worker pool as the plain-UDP path.
+func (srv *Server) listenAndWriteDTLS(ctx context.Context) error {
+	addrs := srv.BindAddrs
+	if len(addrs) == 0 {
+		addr := srv.Addr
+		if addr == "" {
+			addr = ":" + DefaultService
+		}
+		addrs = []string{addr}
+	}
+
+	if srv.BufferSize <= 0 {
+		srv.BufferSize = DefaultBufferSize
+	}
+	if srv.Workers <= 0 {
+		srv.Workers = DefaultWorkers
+	}
+	queueSize := srv.QueueSize
+	if queueSize <= 0 {
+		queueSize = srv.Workers * queueSizePerWorker
+	}
+
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		laddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		ln, err := dtls.Listen("udp", laddr, srv.DTLSConfig)
+		if err != nil {
+			closeListeners(listeners)
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	popts := ParseOpts{
+		PasswordLookup: srv.PasswordLookup,
+		SecurityLevel:  srv.SecurityLevel,
+		TypesDB:        srv.TypesDB,
+	}
+
+	bufPool := &sync.Pool{
+		New: func() interface{} { return make([]byte, srv.BufferSize) },
+	}
+	packets := make(chan packet, queueSize)
+
+	peerConns := newDTLSPeerSet()
+
+	var ctxErr error
+	shutdown := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+			closeListeners(listeners)
+			peerConns.closeAll()
+			return
+		case <-shutdown:
+			return
+		}
+	}()
+
+	workCtx := detach(ctx)
+	var workers sync.WaitGroup
+	workers.Add(srv.Workers)
+	for i := 0; i < srv.Workers; i++ {
+		go func() {
+			defer workers.Done()
+			srv.work(workCtx, packets, bufPool, popts)
+		}()
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- srv.acceptDTLS(ctx, ln, bufPool, packets, peerConns)
+		}(ln)
+	}
+
+	// Draining has two legs that must both finish before packets and the
+	// worker pool can be torn down: waiting out every listener's
+	// accept/peer loop, then waiting for the workers still parsing and
+	// dispatching queued packets. ShutdownTimeout bounds the pair of them
+	// together, not just the worker half, since a DTLS peer stuck in
+	// conn.Read can otherwise block ListenAndWrite indefinitely even
+	// after its connection is closed from under it.
+	//
+	// A genuine (non-context) accept error on any one listener is reported
+	// and closes every listener and peer connection immediately, rather
+	// than leaving the healthy ones running until ctx happens to be
+	// cancelled for an unrelated reason.
+	var readErr error
+	var closeOnce sync.Once
+	drainDone := make(chan struct{})
+	go func() {
+		defer close(drainDone)
+		for range listeners {
+			if err := <-errs; err != nil && readErr == nil {
+				readErr = err
+				srv.handleError(ctx, fmt.Errorf("error accepting DTLS connection: %w", err))
+				closeOnce.Do(func() {
+					closeListeners(listeners)
+					peerConns.closeAll()
+				})
+			}
+		}
+		close(shutdown)
+		close(packets)
+		workers.Wait()
+	}()
+
+	select {
+	case <-drainDone:
+	case <-ctx.Done():
+		if !waitChanTimeout(drainDone, srv.ShutdownTimeout) {
+			return fmt.Errorf("network: timed out after %s waiting for in-flight dispatches to drain", srv.ShutdownTimeout)
+		}
+	}
+
+	if ctxErr != nil {
+		return nil
+	}
+	return readErr
+}
+
+func closeListeners(lns []net.Listener) {
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// dtlsPeerSet tracks the DTLS associations currently being served, so they
+// can be closed on shutdown: closing a net.Listener only stops future
+// Accept() calls, it has no effect on connections it already handed out.
+type dtlsPeerSet struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newDTLSPeerSet() *dtlsPeerSet {
+	return &dtlsPeerSet{conns: make(map[net.Conn]struct{})}
+}
+
+func (s *dtlsPeerSet) add(conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *dtlsPeerSet) remove(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *dtlsPeerSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// acceptDTLS accepts associations on ln, spawning a reader per peer, until
+// ln is closed. Accepted peers are registered in peers so the caller can
+// close them on shutdown.
+func (srv *Server) acceptDTLS(ctx context.Context, ln net.Listener, bufPool *sync.Pool, packets chan<- packet, peers *dtlsPeerSet) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Unblock the deferred wg.Wait() above: without closing the
+			// peers this listener has already handed readers to, their
+			// conn.Read calls never return and this call never returns
+			// the error to the caller for it to act on.
+			peers.closeAll()
+			return err
+		}
+
+		peers.add(conn)
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer peers.remove(conn)
+			defer conn.Close()
+			srv.serveDTLSPeer(ctx, conn, bufPool, packets)
+		}(conn)
+	}
+}
+
+// serveDTLSPeer reads records from a single DTLS association and enqueues
+// them, tagged with the peer's identity, for the worker pool.
+func (srv *Server) serveDTLSPeer(ctx context.Context, conn net.Conn, bufPool *sync.Pool, packets chan<- packet) {
+	id := dtlsPeerIdentity(conn)
+
+	for {
+		buf := bufPool.Get().([]byte)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			bufPool.Put(buf)
+			return
+		}
+		srv.metrics.packetsReceived.Add(1)
+		srv.metrics.bytesReceived.Add(uint64(n))
+
+		select {
+		case packets <- packet{buf: buf, n: n, peer: id}:
+			srv.recordQueueDepth(len(packets))
+		default:
+			srv.metrics.queueFullDrops.Add(1)
+			bufPool.Put(buf)
+		}
+	}
+}
+
+// dtlsPeerIdentity derives a PeerIdentity from an accepted DTLS connection.
+func dtlsPeerIdentity(conn net.Conn) PeerIdentity {
+	id := PeerIdentity{Addr: conn.RemoteAddr()}
+
+	dconn, ok := conn.(*dtls.Conn)
+	if !ok {
+		return id
+	}
+
+	state := dconn.ConnectionState()
+	id.PSKIdentityHint = state.IdentityHint
+	if len(state.PeerCertificates) > 0 {
+		if cert, err := x509.ParseCertificate(state.PeerCertificates[0]); err == nil {
+			id.CommonName = cert.Subject.CommonName
+		}
+	}
+
+	return id
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+// fakeDTLSListener is a net.Listener test double that hands out a fixed
+// sequence of already-established connections before returning a genuine
+// (non-context) error, letting tests drive acceptDTLS's error path without a
+// real DTLS handshake.
+type fakeDTLSListener struct {
+	mu    sync.Mutex
+	conns []net.Conn
+	err   error
+}
+
+func (f *fakeDTLSListener) Accept() (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.conns) > 0 {
+		c := f.conns[0]
+		f.conns = f.conns[1:]
+		return c, nil
+	}
+	return nil, f.err
+}
+
+func (f *fakeDTLSListener) Close() error { return nil }
+func (f *fakeDTLSListener) Addr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+// TestAcceptDTLSClosesPeersOnGenuineError exercises the chunk0-5 accept-error
+// regression: without closing tracked peers before acceptDTLS's deferred
+// wg.Wait(), a live peer's blocked conn.Read keeps acceptDTLS from ever
+// returning the error.
+func TestAcceptDTLSClosesPeersOnGenuineError(t *testing.T) {
+	_, serverConn := net.Pipe()
+
+	ln := &fakeDTLSListener{
+		conns: []net.Conn{serverConn},
+		err:   errors.New("simulated accept failure"),
+	}
+
+	srv := &Server{Writer: discardWriter{}}
+	bufPool := &sync.Pool{New: func() interface{} { return make([]byte, DefaultBufferSize) }}
+	packets := make(chan packet, 1)
+	peers := newDTLSPeerSet()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.acceptDTLS(context.Background(), ln, bufPool, packets, peers)
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil || err.Error() != "simulated accept failure" {
+			t.Fatalf("acceptDTLS returned %v, want the simulated accept failure", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("acceptDTLS did not return: its own accepted peer deadlocked its wg.Wait()")
+	}
+}
+
+// TestDTLSPeerSetCloseAll verifies that closeAll closes every tracked
+// connection, unblocking whatever goroutine is reading from it.
+func TestDTLSPeerSetCloseAll(t *testing.T) {
+	_, serverConn := net.Pipe()
+	peers := newDTLSPeerSet()
+	peers.add(serverConn)
+
+	readDone := make(chan struct{})
+	go func() {
+		var buf [1]byte
+		serverConn.Read(buf[:])
+		close(readDone)
+	}()
+
+	peers.closeAll()
+
+	select {
+	case <-readDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("closeAll did not close the tracked connection")
+	}
+}
+
+// TestListenAndWriteDTLSMultiAddrShutdown is the DTLS counterpart of
+// TestListenAndWriteShutdown: with multiple BindAddrs, cancelling ctx must
+// close every listener and peer connection and return nil, rather than
+// hanging.
+func TestListenAndWriteDTLSMultiAddrShutdown(t *testing.T) {
+	srv := &Server{
+		BindAddrs:       []string{freeUDPAddr(t), freeUDPAddr(t)},
+		Writer:          discardWriter{},
+		DTLSConfig:      &dtls.Config{},
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndWrite(ctx)
+	}()
+
+	// Give ListenAndWrite a moment to open its listeners before asking it
+	// to shut down.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("ListenAndWrite returned %v, want nil on clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndWrite did not return after ctx was cancelled")
+	}
+}
@@ -0,0 +1,52 @@
+package network
+
+import "sync/atomic"
+
+// Metrics is a point-in-time snapshot of a Server's counters, returned by
+// Server.Stats.
+type Metrics struct {
+	PacketsReceived    uint64 // UDP datagrams received, across all sockets.
+	BytesReceived      uint64 // Bytes received, across all sockets.
+	ParseErrors        uint64 // Parse failures other than security rejections.
+	SecurityRejections uint64 // Packets rejected by PasswordLookup/SecurityLevel checks.
+	SourceRejections   uint64 // Packets rejected by AllowedNets/DeniedNets.
+	DispatchErrors     uint64 // Writer.Write failures.
+	QueueFullDrops     uint64 // Packets dropped because the dispatch queue was full.
+}
+
+// serverMetrics holds the live counters backing Metrics. It uses the typed
+// atomic.Uint64 rather than plain uint64 fields updated via
+// atomic.AddUint64/LoadUint64: a raw field's required 8-byte alignment
+// isn't guaranteed on 32-bit platforms unless it's the first word of the
+// struct it's embedded in, which is not the case here.
+type serverMetrics struct {
+	packetsReceived    atomic.Uint64
+	bytesReceived      atomic.Uint64
+	parseErrors        atomic.Uint64
+	securityRejections atomic.Uint64
+	sourceRejections   atomic.Uint64
+	dispatchErrors     atomic.Uint64
+	queueFullDrops     atomic.Uint64
+}
+
+// Stats returns a snapshot of srv's Metrics counters.
+func (srv *Server) Stats() Metrics {
+	return Metrics{
+		PacketsReceived:    srv.metrics.packetsReceived.Load(),
+		BytesReceived:      srv.metrics.bytesReceived.Load(),
+		ParseErrors:        srv.metrics.parseErrors.Load(),
+		SecurityRejections: srv.metrics.securityRejections.Load(),
+		SourceRejections:   srv.metrics.sourceRejections.Load(),
+		DispatchErrors:     srv.metrics.dispatchErrors.Load(),
+		QueueFullDrops:     srv.metrics.queueFullDrops.Load(),
+	}
+}
+
+// securityError is implemented by parse errors that indicate a packet
+// failed signature verification or decryption, as opposed to simply being
+// malformed. Parse errors that don't implement it are counted as
+// ParseErrors rather than SecurityRejections.
+type securityError interface {
+	error
+	Security() bool
+}
@@ -0,0 +1,42 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Netlist is an ordered list of IP networks, used to allow- or deny-list the
+// source addresses of incoming packets.
+type Netlist []*net.IPNet
+
+// ParseNetlist parses a comma-separated list of CIDR masks, e.g.
+// "10.0.0.0/8,192.168.1.0/24,::1/128", into a Netlist. An empty string
+// yields an empty, non-nil Netlist.
+func ParseNetlist(s string) (Netlist, error) {
+	if s == "" {
+		return Netlist{}, nil
+	}
+
+	var nl Netlist
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("network: invalid CIDR mask %q: %w", cidr, err)
+		}
+		nl = append(nl, ipNet)
+	}
+	return nl, nil
+}
+
+// Contains reports whether ip is covered by any network in the list. An
+// empty Netlist contains nothing.
+func (nl Netlist) Contains(ip net.IP) bool {
+	for _, ipNet := range nl {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetlist(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "empty", s: "", wantLen: 0},
+		{name: "single v4", s: "10.0.0.0/8", wantLen: 1},
+		{name: "multiple with whitespace", s: "10.0.0.0/8, 192.168.1.0/24", wantLen: 2},
+		{name: "v6", s: "::1/128", wantLen: 1},
+		{name: "mixed v4 and v6", s: "10.0.0.0/8,::1/128", wantLen: 2},
+		{name: "invalid CIDR", s: "not-a-cidr", wantErr: true},
+		{name: "one invalid among valid", s: "10.0.0.0/8,garbage", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nl, err := ParseNetlist(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseNetlist(%q): expected error, got nil", tt.s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseNetlist(%q): unexpected error: %v", tt.s, err)
+			}
+			if len(nl) != tt.wantLen {
+				t.Fatalf("ParseNetlist(%q): got %d networks, want %d", tt.s, len(nl), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestParseNetlistEmptyIsNonNil(t *testing.T) {
+	nl, err := ParseNetlist("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nl == nil {
+		t.Fatal("ParseNetlist(\"\") returned a nil Netlist, want non-nil empty Netlist")
+	}
+}
+
+func TestNetlistContains(t *testing.T) {
+	nl, err := ParseNetlist("10.0.0.0/8,192.168.1.0/24,::1/128")
+	if err != nil {
+		t.Fatalf("ParseNetlist: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{name: "covered by first v4 network", ip: "10.1.2.3", want: true},
+		{name: "covered by second v4 network", ip: "192.168.1.42", want: true},
+		{name: "v4 address outside both networks", ip: "8.8.8.8", want: false},
+		{name: "v6 loopback covered", ip: "::1", want: true},
+		{name: "other v6 address not covered", ip: "2001:db8::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("net.ParseIP(%q) returned nil", tt.ip)
+			}
+			if got := nl.Contains(ip); got != tt.want {
+				t.Errorf("Netlist.Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyNetlistContainsNothing(t *testing.T) {
+	var nl Netlist
+	if nl.Contains(net.ParseIP("10.0.0.1")) {
+		t.Error("empty Netlist.Contains returned true, want false")
+	}
+}
+
+func TestAllowedNetsAndDeniedNetsInteraction(t *testing.T) {
+	allowed, err := ParseNetlist("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseNetlist(allowed): unexpected error: %v", err)
+	}
+	denied, err := ParseNetlist("10.0.1.0/24")
+	if err != nil {
+		t.Fatalf("ParseNetlist(denied): unexpected error: %v", err)
+	}
+	srv := &Server{AllowedNets: allowed, DeniedNets: denied}
+
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{name: "allowed and not denied", ip: "10.0.2.1", want: true},
+		{name: "allowed but also denied", ip: "10.0.1.1", want: false},
+		{name: "not in allowed list at all", ip: "192.168.1.1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := srv.sourceAllowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("sourceAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
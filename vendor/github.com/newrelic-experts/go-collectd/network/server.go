@@ -2,12 +2,44 @@ package network
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
 
 	"github.com/newrelic-experts/go-collectd/api"
 )
 
+const (
+	// DefaultReadBufferBytes is the socket receive buffer size applied to
+	// listening sockets when Server.ReadBufferBytes is unset.
+	DefaultReadBufferBytes = 2 * 1024 * 1024 // 2 MiB
+
+	// DefaultWorkers is the number of dispatch workers started when
+	// Server.Workers is unset.
+	DefaultWorkers = 4
+
+	// queueSizePerWorker sizes the packet queue relative to Workers when
+	// Server.QueueSize is unset.
+	queueSizePerWorker = 64
+)
+
+// packet is a received-but-not-yet-parsed datagram, queued between a
+// socket's reader goroutine and the worker pool.
+type packet struct {
+	buf   []byte // full buffer, as handed out by the pool
+	n     int    // number of valid bytes in buf
+	raddr *net.UDPAddr
+
+	// peer identifies the sender when the packet arrived over a DTLS
+	// association. Zero value for plain UDP packets.
+	peer PeerIdentity
+}
+
 // ListenAndWrite listens on the provided UDP address, parses the received
 // packets and writes them to the provided api.Writer.
 // This is a convenience function for a minimally configured server. If you
@@ -22,58 +54,146 @@ func ListenAndWrite(ctx context.Context, address string, d api.Writer) error {
 
 // Server holds parameters for running a collectd server.
 type Server struct {
-	// UDP connection the server listens on. If Conn is nil, a new server
-	// connection is opened. The connection is closed by ListenAndWrite
-	// before returning.
+	// UDP connection the server listens on. If Conn is nil, new server
+	// connections are opened from Addr / BindAddrs instead. The
+	// connection is closed by ListenAndWrite before returning. Conn takes
+	// precedence over Addr and BindAddrs. Conn is not used when DTLSConfig
+	// is set.
 	Conn *net.UDPConn
-	// Address to listen on if Conn is nil. If Addr is empty, too, then the
-	// "any" interface and the DefaultService will be used.
-	Addr           string
+	// Address to listen on if Conn is nil and BindAddrs is empty. If Addr
+	// is empty, too, then the "any" interface and the DefaultService will
+	// be used.
+	Addr string
+	// BindAddrs lists multiple addresses to listen on simultaneously, e.g.
+	// to subscribe to several multicast groups at once (such as both the
+	// IPv4 "239.192.74.66" and IPv6 "ff18::efc0:4a42" collectd groups) or
+	// to bind several NICs from a single process. When non-empty it takes
+	// precedence over Addr.
+	BindAddrs      []string
 	Writer         api.Writer     // Object used to send incoming ValueLists to.
 	BufferSize     uint16         // Maximum packet size to accept.
 	PasswordLookup PasswordLookup // User to password lookup.
 	SecurityLevel  SecurityLevel  // Minimal required security level.
 	TypesDB        *api.TypesDB   // TypesDB for looking up DS names and verify data source types.
 	// Interface is the name of the interface to use when subscribing to a
-	// multicast group. Has no effect when using unicast.
+	// multicast group via Addr. Has no effect when using unicast. When
+	// BindAddrs is set, Interfaces takes precedence; if Interfaces is empty,
+	// Interface is used for every address in BindAddrs.
 	Interface string
+	// Interfaces names the interface to use for each corresponding entry
+	// in BindAddrs, when subscribing to a multicast group. It must either
+	// be empty, have a single entry (applied to every address in
+	// BindAddrs) or have the same length as BindAddrs.
+	Interfaces []string
+	// AllowedNets, if non-empty, restricts accepted packets to those
+	// arriving from a source address covered by one of its networks.
+	// Packets from any other source are dropped before parsing.
+	AllowedNets Netlist
+	// DeniedNets, if non-empty, causes packets arriving from a source
+	// address covered by one of its networks to be dropped before
+	// parsing. DeniedNets is checked after AllowedNets.
+	DeniedNets Netlist
+	// ReadBufferBytes sets the kernel socket receive buffer size (via
+	// SetReadBuffer) on every listening socket. Defaults to
+	// DefaultReadBufferBytes. Not applied when DTLSConfig is set.
+	ReadBufferBytes int
+	// Workers is the number of goroutines parsing packets and writing the
+	// results to Writer. Reader goroutines only copy bytes off the wire
+	// and enqueue them, so tuning Workers (and QueueSize) lets operators
+	// absorb bursty traffic without dropping packets. Defaults to
+	// DefaultWorkers.
+	Workers int
+	// QueueSize bounds the channel of received-but-unparsed packets
+	// shared by all readers and workers. Defaults to Workers *
+	// queueSizePerWorker.
+	QueueSize int
+	// ErrorHandler, if set, is called instead of logging to the standard
+	// logger whenever a socket, parse or dispatch error occurs. This lets
+	// callers surface errors through their own observability stack rather
+	// than scraping stderr.
+	ErrorHandler func(context.Context, error)
+	// DTLSConfig, if set, makes ListenAndWrite accept DTLS associations
+	// instead of plain UDP packets, giving operators an authenticated,
+	// encrypted transport alongside collectd's built-in per-packet
+	// Sign/Encrypt modes (PasswordLookup/SecurityLevel). AllowedNets and
+	// DeniedNets are not consulted on this path; DTLS's own handshake is
+	// the access-control boundary. On this path one DTLS listener is opened
+	// per Addr / BindAddrs entry; Conn, Interface, Interfaces and
+	// ReadBufferBytes are not used.
+	DTLSConfig *dtls.Config
+	// ShutdownTimeout bounds how long ListenAndWrite waits, after ctx is
+	// cancelled, for in-flight parses and dispatches to finish before
+	// giving up. Zero means wait indefinitely. If the timeout is reached,
+	// ListenAndWrite returns an error even though the worker goroutines
+	// may still be running and writing to Writer in the background; as
+	// with http.Server.Shutdown, a non-zero ShutdownTimeout trades a
+	// prompt return for that guarantee.
+	ShutdownTimeout time.Duration
+
+	// queueHighWater uses the typed atomic.Int64 rather than a plain int64
+	// updated via atomic.AddInt64/CompareAndSwapInt64: a raw field isn't
+	// guaranteed to be 8-byte aligned on 32-bit platforms unless it's the
+	// first word of the struct, which this isn't.
+	queueHighWater atomic.Int64 // see QueueHighWaterMark
+	metrics        serverMetrics
 }
 
-// ListenAndWrite listens on the provided UDP connection (or creates one using
-// Addr if Conn is nil), parses the received packets and writes them to the
-// provided api.Writer.
-func (srv *Server) ListenAndWrite(ctx context.Context) error {
-	if srv.Conn == nil {
-		addr := srv.Addr
-		if addr == "" {
-			addr = ":" + DefaultService
-		}
+// handleError reports err via ErrorHandler if set, or the standard logger
+// otherwise.
+func (srv *Server) handleError(ctx context.Context, err error) {
+	if srv.ErrorHandler != nil {
+		srv.ErrorHandler(ctx, err)
+		return
+	}
+	log.Printf("%v", err)
+}
 
-		laddr, err := net.ResolveUDPAddr("udp", srv.Addr)
-		if err != nil {
-			return err
-		}
+// QueueHighWaterMark returns the largest number of packets observed waiting
+// in the dispatch queue since the server started, for sizing Workers and
+// QueueSize.
+func (srv *Server) QueueHighWaterMark() int64 {
+	return srv.queueHighWater.Load()
+}
 
-		if laddr.IP != nil && laddr.IP.IsMulticast() {
-			var ifi *net.Interface
-			if srv.Interface != "" {
-				if ifi, err = net.InterfaceByName(srv.Interface); err != nil {
-					return err
-				}
-			}
-			srv.Conn, err = net.ListenMulticastUDP("udp", ifi, laddr)
-		} else {
-			srv.Conn, err = net.ListenUDP("udp", laddr)
+func (srv *Server) recordQueueDepth(depth int) {
+	for {
+		cur := srv.queueHighWater.Load()
+		if int64(depth) <= cur {
+			return
 		}
-		if err != nil {
-			return err
+		if srv.queueHighWater.CompareAndSwap(cur, int64(depth)) {
+			return
 		}
 	}
+}
+
+// ListenAndWrite listens on the provided UDP connection (or opens one or
+// more, using Addr / BindAddrs, if Conn is nil), parses the received
+// packets and writes them to the provided api.Writer.
+//
+// When multiple addresses are configured, ListenAndWrite opens one socket
+// per address, fans reads from all of them into a shared parse/dispatch
+// pipeline, and shuts every socket down cleanly when ctx is done.
+func (srv *Server) ListenAndWrite(ctx context.Context) error {
+	if srv.DTLSConfig != nil {
+		return srv.listenAndWriteDTLS(ctx)
+	}
+
+	conns, err := srv.listen()
+	if err != nil {
+		return err
+	}
 
 	if srv.BufferSize <= 0 {
 		srv.BufferSize = DefaultBufferSize
 	}
-	buf := make([]byte, srv.BufferSize)
+	if srv.Workers <= 0 {
+		srv.Workers = DefaultWorkers
+	}
+	queueSize := srv.QueueSize
+	if queueSize <= 0 {
+		queueSize = srv.Workers * queueSizePerWorker
+	}
 
 	popts := ParseOpts{
 		PasswordLookup: srv.PasswordLookup,
@@ -81,57 +201,281 @@ func (srv *Server) ListenAndWrite(ctx context.Context) error {
 		TypesDB:        srv.TypesDB,
 	}
 
+	bufPool := &sync.Pool{
+		New: func() interface{} { return make([]byte, srv.BufferSize) },
+	}
+	packets := make(chan packet, queueSize)
+
 	var ctxErr error
 	shutdown := make(chan struct{})
 	go func() {
 		select {
 		case <-ctx.Done():
 			ctxErr = ctx.Err()
-			// this interrupts the below Conn.Read().
-			srv.Conn.Close()
+			// this interrupts the conn.ReadFromUDP() calls in serve.
+			for _, conn := range conns {
+				conn.Close()
+			}
 			return
 		case <-shutdown:
 			return
 		}
 	}()
 
+	workCtx := detach(ctx)
+	var workers sync.WaitGroup
+	workers.Add(srv.Workers)
+	for i := 0; i < srv.Workers; i++ {
+		go func() {
+			defer workers.Done()
+			srv.work(workCtx, packets, bufPool, popts)
+		}()
+	}
+
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go srv.serve(ctx, conn, bufPool, packets, errs)
+	}
+
+	// A genuine (non-context) read error on any one socket is reported and
+	// closes every socket immediately, rather than leaving the healthy
+	// ones running until ctx happens to be cancelled for an unrelated
+	// reason.
+	var readErr error
+	var closeOnce sync.Once
+	for range conns {
+		if err := <-errs; err != nil && readErr == nil {
+			readErr = err
+			srv.handleError(ctx, fmt.Errorf("error reading from socket: %w", err))
+			closeOnce.Do(func() {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			})
+		}
+	}
+	close(shutdown)
+	close(packets)
+	drained := waitTimeout(&workers, srv.ShutdownTimeout)
+	srv.Conn = nil
+
+	if ctxErr != nil {
+		if !drained {
+			return fmt.Errorf("network: timed out after %s waiting for in-flight dispatches to drain", srv.ShutdownTimeout)
+		}
+		return nil
+	}
+	return readErr
+}
+
+// detach returns a context carrying ctx's values but that never reports
+// itself as done, so work started before ctx is cancelled (e.g. an
+// in-flight Writer.Write) can still run to completion during shutdown.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
+
+// waitTimeout waits for wg, like wg.Wait, but gives up after timeout
+// (unless timeout is zero, meaning wait indefinitely). Reports whether wg
+// finished before the deadline.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return waitChanTimeout(done, timeout)
+}
+
+// waitChanTimeout waits for done to be closed, but gives up after timeout
+// (unless timeout is zero, meaning wait indefinitely). Reports whether done
+// closed before the deadline.
+func waitChanTimeout(done <-chan struct{}, timeout time.Duration) bool {
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// listen resolves the configured addresses and opens the underlying UDP
+// sockets, honouring Conn, Addr, BindAddrs, Interface and Interfaces.
+func (srv *Server) listen() ([]*net.UDPConn, error) {
+	if srv.Conn != nil {
+		return []*net.UDPConn{srv.Conn}, nil
+	}
+
+	addrs := srv.BindAddrs
+	if len(addrs) == 0 {
+		addr := srv.Addr
+		if addr == "" {
+			addr = ":" + DefaultService
+		}
+		addrs = []string{addr}
+	}
+
+	ifaces := srv.Interfaces
+	if len(ifaces) == 0 {
+		ifaces = []string{srv.Interface}
+	}
+	if len(ifaces) != 1 && len(ifaces) != len(addrs) {
+		return nil, fmt.Errorf("network: got %d interfaces for %d bind addresses", len(ifaces), len(addrs))
+	}
+
+	var conns []*net.UDPConn
+	for i, addr := range addrs {
+		ifaceName := ifaces[0]
+		if len(ifaces) == len(addrs) {
+			ifaceName = ifaces[i]
+		}
+
+		conn, err := listenOne(addr, ifaceName)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	return conns, nil
+}
+
+// listenOne opens a single UDP socket for addr, joining the multicast group
+// on iface if addr is a multicast address.
+func listenOne(addr, iface string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if laddr.IP != nil && laddr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if iface != "" {
+			if ifi, err = net.InterfaceByName(iface); err != nil {
+				return nil, err
+			}
+		}
+		return net.ListenMulticastUDP("udp", ifi, laddr)
+	}
+
+	return net.ListenUDP("udp", laddr)
+}
+
+// serve runs the read loop for a single UDP socket: it only copies bytes off
+// the wire and enqueues them onto packets for the worker pool to parse and
+// dispatch. It sends exactly one error (nil on a context-triggered
+// shutdown) to errs before returning.
+func (srv *Server) serve(ctx context.Context, conn *net.UDPConn, bufPool *sync.Pool, packets chan<- packet, errs chan<- error) {
+	readBufferBytes := srv.ReadBufferBytes
+	if readBufferBytes <= 0 {
+		readBufferBytes = DefaultReadBufferBytes
+	}
+	if err := conn.SetReadBuffer(readBufferBytes); err != nil {
+		srv.handleError(ctx, fmt.Errorf("error setting read buffer size: %w", err))
+	}
+
 	for {
-		n, err := srv.Conn.Read(buf)
+		buf := bufPool.Get().([]byte)
+
+		n, raddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			// if ctxErr is non-nil the context got cancelled.
-			if ctxErr != nil {
-				srv.Conn = nil
-				return ctxErr
+			bufPool.Put(buf)
+			if ctx.Err() != nil {
+				errs <- nil
+				return
 			}
+			errs <- err
+			return
+		}
+		srv.metrics.packetsReceived.Add(1)
+		srv.metrics.bytesReceived.Add(uint64(n))
 
-			// network error: shutdown the goroutine, close the
-			// connection and return.
-			close(shutdown)
-			srv.Conn.Close()
-			srv.Conn = nil
-			return err
+		if !srv.sourceAllowed(raddr.IP) {
+			srv.metrics.sourceRejections.Add(1)
+			bufPool.Put(buf)
+			continue
 		}
 
-		valueLists, err := Parse(buf[:n], popts)
+		select {
+		case packets <- packet{buf: buf, n: n, raddr: raddr}:
+			srv.recordQueueDepth(len(packets))
+		default:
+			srv.metrics.queueFullDrops.Add(1)
+			bufPool.Put(buf)
+		}
+	}
+}
+
+// work pulls packets off the shared queue, parses them and dispatches the
+// resulting ValueLists to Writer, until packets is closed.
+func (srv *Server) work(ctx context.Context, packets <-chan packet, bufPool *sync.Pool, popts ParseOpts) {
+	for p := range packets {
+		valueLists, err := Parse(p.buf[:p.n], popts)
+		bufPool.Put(p.buf)
 		if err != nil {
-			log.Printf("error while parsing: %v", err)
+			if se, ok := err.(securityError); ok && se.Security() {
+				srv.metrics.securityRejections.Add(1)
+			} else {
+				srv.metrics.parseErrors.Add(1)
+			}
+			srv.handleError(ctx, fmt.Errorf("error while parsing: %w", err))
 			continue
 		}
 
-		go dispatch(ctx, valueLists, srv.Writer)
+		dctx := ctx
+		if p.peer.Addr != nil {
+			dctx = context.WithValue(ctx, peerIdentityKey{}, p.peer)
+		}
+		srv.dispatch(dctx, valueLists)
+	}
+}
+
+// sourceAllowed reports whether a packet from ip should be accepted,
+// applying AllowedNets and then DeniedNets. A nil/empty AllowedNets allows
+// every source; DeniedNets, when set, rejects matching sources even if
+// AllowedNets let them through.
+func (srv *Server) sourceAllowed(ip net.IP) bool {
+	if len(srv.AllowedNets) > 0 && !srv.AllowedNets.Contains(ip) {
+		return false
+	}
+	if srv.DeniedNets.Contains(ip) {
+		return false
 	}
+	return true
 }
 
-func dispatch(ctx context.Context, valueLists []*api.ValueList, d api.Writer) {
+func (srv *Server) dispatch(ctx context.Context, valueLists []*api.ValueList) {
 	//Custom modification to send all valuelist at once rather than one by one to the New Relic listener
 	/*
 		for _, vl := range valueLists {
-			if err := d.Write(ctx, vl); err != nil {
-				log.Printf("error while dispatching: %v", err)
+			if err := srv.Writer.Write(ctx, vl); err != nil {
+				srv.handleError(ctx, fmt.Errorf("error while dispatching: %w", err))
 			}
 		}
 	*/
-	if err := d.Write(ctx, valueLists); err != nil {
-		log.Printf("error while dispatching: %v", err)
+	if err := srv.Writer.Write(ctx, valueLists); err != nil {
+		srv.metrics.dispatchErrors.Add(1)
+		srv.handleError(ctx, fmt.Errorf("error while dispatching: %w", err))
 	}
 }
@@ -0,0 +1,149 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/newrelic-experts/go-collectd/api"
+)
+
+// discardWriter is an api.Writer that accepts every ValueList without error,
+// for tests that only care about the server's listen/shutdown behaviour.
+type discardWriter struct{}
+
+func (discardWriter) Write(context.Context, []*api.ValueList) error { return nil }
+
+// freeUDPAddr reserves an ephemeral UDP port on loopback and returns its
+// address, for tests that need a known address to pass via BindAddrs before
+// the Server itself opens the socket.
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("failed to reserve a UDP address: %v", err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+// TestListenAndWriteShutdown verifies that cancelling the context passed to
+// ListenAndWrite closes the listening socket, drains the worker pool and
+// returns nil -- as opposed to hanging or surfacing ctx.Err() to the caller.
+func TestListenAndWriteShutdown(t *testing.T) {
+	srv := &Server{
+		Addr:            "127.0.0.1:0",
+		Writer:          discardWriter{},
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndWrite(ctx)
+	}()
+
+	// Give ListenAndWrite a moment to open its socket and start serving
+	// before asking it to shut down.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("ListenAndWrite returned %v, want nil on clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndWrite did not return after ctx was cancelled")
+	}
+}
+
+// TestListenAndWriteBindAddrs verifies that BindAddrs opens a socket per
+// address and that packets arriving on either one are counted, and that
+// every socket is closed cleanly when ctx is cancelled.
+func TestListenAndWriteBindAddrs(t *testing.T) {
+	addrs := []string{freeUDPAddr(t), freeUDPAddr(t)}
+	srv := &Server{
+		BindAddrs:       addrs,
+		Writer:          discardWriter{},
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndWrite(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatalf("net.Dial(%q): %v", addr, err)
+		}
+		if _, err := conn.Write([]byte("not a collectd packet")); err != nil {
+			t.Fatalf("conn.Write: %v", err)
+		}
+		conn.Close()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("ListenAndWrite returned %v, want nil on clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndWrite did not return after ctx was cancelled")
+	}
+
+	if got := srv.Stats().PacketsReceived; got != uint64(len(addrs)) {
+		t.Errorf("Stats().PacketsReceived = %d, want %d (one per BindAddrs socket)", got, len(addrs))
+	}
+}
+
+// TestRecordQueueDepthHighWaterMark verifies that recordQueueDepth only ever
+// raises queueHighWater, keeping the largest depth observed.
+func TestRecordQueueDepthHighWaterMark(t *testing.T) {
+	srv := &Server{}
+
+	for _, depth := range []int{3, 1, 7, 2} {
+		srv.recordQueueDepth(depth)
+	}
+
+	if got := srv.QueueHighWaterMark(); got != 7 {
+		t.Fatalf("QueueHighWaterMark() = %d, want 7", got)
+	}
+}
+
+// TestStats verifies that Stats returns a snapshot of the live counters.
+func TestStats(t *testing.T) {
+	srv := &Server{}
+	srv.metrics.packetsReceived.Add(3)
+	srv.metrics.bytesReceived.Add(128)
+	srv.metrics.parseErrors.Add(1)
+	srv.metrics.securityRejections.Add(2)
+	srv.metrics.sourceRejections.Add(4)
+	srv.metrics.dispatchErrors.Add(5)
+	srv.metrics.queueFullDrops.Add(6)
+
+	want := Metrics{
+		PacketsReceived:    3,
+		BytesReceived:      128,
+		ParseErrors:        1,
+		SecurityRejections: 2,
+		SourceRejections:   4,
+		DispatchErrors:     5,
+		QueueFullDrops:     6,
+	}
+	if got := srv.Stats(); got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+}